@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	forceRefresh = flag.Bool("force-refresh", false, "ignore the geolocation cache and re-look-up every IP")
+	cacheTTL     = flag.Duration("cache-ttl", 30*24*time.Hour, "how long a successful geolocation lookup stays cached")
+	negativeTTL  = flag.Duration("negative-cache-ttl", 24*time.Hour, "how long a failed (\"fail\" status) lookup stays cached before being retried")
+)
+
+// CacheStats is reported in the final log line so operators can see how much
+// of a run was served from the cache vs. the upstream providers.
+type CacheStats struct {
+	Hits   int
+	Misses int
+}
+
+// ensureGeolocationSchema adds the LookedUpAt and Status columns to the
+// Geolocation table if they aren't already present. The table itself is
+// created by the honeypot software, not this tool, so we migrate it in place
+// rather than assuming a fixed schema.
+func ensureGeolocationSchema() error {
+	existing := map[string]bool{}
+	rows, err := Database.Query("PRAGMA table_info(Geolocation);")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dfltValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if !existing["LookedUpAt"] {
+		if _, err := Database.Exec("ALTER TABLE Geolocation ADD COLUMN LookedUpAt TIMESTAMP;"); err != nil {
+			return err
+		}
+	}
+	if !existing["Status"] {
+		if _, err := Database.Exec("ALTER TABLE Geolocation ADD COLUMN Status TEXT DEFAULT 'success';"); err != nil {
+			return err
+		}
+	}
+
+	// storeGeolocationData upserts on RemoteIP, which needs a unique index to
+	// give SQLite something for ON CONFLICT to match. The honeypot's stock
+	// table has no such constraint (the original code just did a plain
+	// INSERT), so create one here; if older duplicate rows block that, dedupe
+	// them first, keeping the most recently inserted row per IP.
+	if _, err := Database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_geolocation_remoteip ON Geolocation(RemoteIP);"); err != nil {
+		if _, derr := Database.Exec(`DELETE FROM Geolocation WHERE rowid NOT IN (
+			SELECT MAX(rowid) FROM Geolocation GROUP BY RemoteIP
+		);`); derr != nil {
+			return fmt.Errorf("deduplicating Geolocation rows before indexing: %w", derr)
+		}
+		if _, err := Database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_geolocation_remoteip ON Geolocation(RemoteIP);"); err != nil {
+			return fmt.Errorf("creating unique index on Geolocation.RemoteIP: %w", err)
+		}
+	}
+	return nil
+}
+
+// filterUncachedIPs drops any IP whose Geolocation row is still fresh.
+// Successful lookups stay cached for cacheTTL; "fail" lookups (invalid or
+// private-range addresses ip-api refuses to resolve) are only trusted for
+// negativeTTL, which is normally much shorter, so they get retried sooner
+// rather than being cached as permanently unresolvable.
+func filterUncachedIPs(ips []string, cacheTTL, negativeTTL time.Duration) ([]string, CacheStats) {
+	if *forceRefresh {
+		return ips, CacheStats{Misses: len(ips)}
+	}
+
+	fresh := make(map[string]bool)
+	rows, err := Database.Query("SELECT RemoteIP, Status, LookedUpAt FROM Geolocation;")
+	if err != nil {
+		log.Println("cache lookup failed, treating all IPs as uncached:", err)
+		return ips, CacheStats{Misses: len(ips)}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip, status string
+		var lookedUpAt sql.NullString
+		if err := rows.Scan(&ip, &status, &lookedUpAt); err != nil {
+			continue
+		}
+		if !lookedUpAt.Valid {
+			continue
+		}
+		seenAt, err := time.Parse(time.RFC3339, lookedUpAt.String)
+		if err != nil {
+			continue
+		}
+		ttl := cacheTTL
+		if status == "fail" {
+			ttl = negativeTTL
+		}
+		if time.Since(seenAt) < ttl {
+			fresh[ip] = true
+		}
+	}
+
+	var stats CacheStats
+	var uncached []string
+	for _, ip := range ips {
+		if fresh[ip] {
+			stats.Hits++
+		} else {
+			stats.Misses++
+			uncached = append(uncached, ip)
+		}
+	}
+	return uncached, stats
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ProviderConfig describes one entry in the provider chain. Params is
+// provider-specific: ip-api needs none, maxmind needs "dbPath", and the
+// generic HTTP provider needs "urlTemplate", "quota" and "windowSeconds", plus
+// an optional "responseFormat" ("ip-api", the default, or "ipinfo") telling it
+// how to decode urlTemplate's response - any other endpoint must already
+// return the ip-api.com field schema.
+type ProviderConfig struct {
+	Type   string            `json:"type" yaml:"type"`
+	Name   string            `json:"name" yaml:"name"`
+	Params map[string]string `json:"params" yaml:"params"`
+}
+
+// Config is the top-level config file format, e.g.:
+//
+//	providers:
+//	  - type: ip-api
+//	  - type: maxmind
+//	    params: {dbPath: GeoLite2-City.mmdb}
+//	  - type: http
+//	    name: ipinfo.io
+//	    params: {urlTemplate: "https://ipinfo.io/%s/json", responseFormat: ipinfo, quota: "50", windowSeconds: "60"}
+type Config struct {
+	Providers []ProviderConfig `json:"providers" yaml:"providers"`
+}
+
+// LoadConfig reads a provider chain configuration from a JSON or YAML file,
+// dispatching on the file extension.
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &cfg)
+	case ".json":
+		err = json.Unmarshal(raw, &cfg)
+	default:
+		return nil, fmt.Errorf("unrecognised config extension %q (want .json, .yaml or .yml)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// BuildProviderChain instantiates the GeoProvider chain described by cfg.
+func BuildProviderChain(cfg *Config) (*ProviderChain, error) {
+	var providers []GeoProvider
+	for _, pc := range cfg.Providers {
+		switch pc.Type {
+		case "ip-api":
+			providers = append(providers, newIPAPIProvider())
+		case "maxmind":
+			dbPath, ok := pc.Params["dbPath"]
+			if !ok {
+				return nil, fmt.Errorf("maxmind provider requires a dbPath param")
+			}
+			provider, err := newMaxMindProvider(dbPath)
+			if err != nil {
+				return nil, fmt.Errorf("opening maxmind db: %w", err)
+			}
+			providers = append(providers, provider)
+		case "http":
+			urlTmpl, ok := pc.Params["urlTemplate"]
+			if !ok {
+				return nil, fmt.Errorf("http provider requires a urlTemplate param")
+			}
+			quota := atoiOrDefault(pc.Params["quota"], 45)
+			windowSeconds := atoiOrDefault(pc.Params["windowSeconds"], 60)
+			responseFormat := pc.Params["responseFormat"]
+			if responseFormat == "" {
+				responseFormat = responseFormatIPAPI
+			}
+			name := pc.Name
+			if name == "" {
+				name = "http-per-ip"
+			}
+			providers = append(providers, newHTTPPerIPProvider(name, urlTmpl, responseFormat, quota, time.Duration(windowSeconds)*time.Second))
+		default:
+			return nil, fmt.Errorf("unknown provider type %q", pc.Type)
+		}
+	}
+	return NewProviderChain(providers...), nil
+}
+
+func atoiOrDefault(s string, def int) int {
+	var n int
+	if _, err := fmt.Sscanf(s, "%d", &n); err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
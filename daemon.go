@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	daemonMode   = flag.Bool("daemon", false, "run continuously, polling the honeypot DB for new logins instead of exiting after one pass")
+	pollInterval = flag.Duration("poll-interval", time.Minute, "how often to check for new Login rows in --daemon mode")
+	listenAddr   = flag.String("listen-addr", ":9090", "address for the /metrics, /healthz and /stats endpoints in --daemon mode")
+	honeypotDB   = flag.String("honeypot-db", "honeypot.db", "path to the honeypot's on-disk SQLite database file, opened read-only to poll for new Login rows in --daemon mode")
+)
+
+// daemonStats tracks the running totals exposed over HTTP so the tool can be
+// monitored as a systemd service or a sidecar next to Cowrie/Kippo.
+type daemonStats struct {
+	mu             sync.Mutex
+	queueDepth     int
+	cacheHits      int
+	cacheMisses    int
+	providerErrors int
+	startedAt      time.Time
+}
+
+func newDaemonStats() *daemonStats {
+	return &daemonStats{startedAt: time.Now()}
+}
+
+func (s *daemonStats) recordPass(depth int, cache CacheStats, providerErrs int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueDepth = depth
+	s.cacheHits += cache.Hits
+	s.cacheMisses += cache.Misses
+	s.providerErrors += providerErrs
+}
+
+func (s *daemonStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hitRatio := 0.0
+	if total := s.cacheHits + s.cacheMisses; total > 0 {
+		hitRatio = float64(s.cacheHits) / float64(total)
+	}
+	return map[string]interface{}{
+		"uptimeSeconds":               time.Since(s.startedAt).Seconds(),
+		"queueDepth":                  s.queueDepth,
+		"cacheHits":                   s.cacheHits,
+		"cacheMisses":                 s.cacheMisses,
+		"cacheHitRatio":               hitRatio,
+		"providerErrors":              s.providerErrors,
+		"rateLimitBudgetMsPerRequest": float64(limiter.Budget()) / float64(time.Millisecond),
+	}
+}
+
+// serveMetrics starts the /metrics, /healthz and /stats endpoints used to
+// monitor a --daemon run. It runs until ctx is cancelled.
+func serveMetrics(ctx context.Context, stats *daemonStats) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.snapshot())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		snap := stats.snapshot()
+		for key, value := range snap {
+			fmt.Fprintf(w, "honeypot_geolocation_%s %v\n", key, value)
+		}
+	})
+
+	server := &http.Server{Addr: *listenAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Println("metrics server listening on", *listenAddr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println("metrics server stopped:", err)
+	}
+}
+
+// runDaemon polls the Login table for unseen rows every pollInterval and
+// pushes their IPs through the normal geolocation pipeline, rather than
+// running once and exiting. SIGINT/SIGTERM trigger a graceful shutdown that
+// lets any in-flight chunk finish (or be queued for resume) before exiting.
+//
+// Polling reads from honeypotDB, a dedicated read-only connection to the
+// honeypot's on-disk database file - unlike Database (geolocate.go's
+// connectDB), which opens an in-memory, process-private DB for the
+// geolocation cache and is never touched by Cowrie/Kippo, so it would never
+// see a login an attacker actually triggered.
+func runDaemon() error {
+	db, err := sql.Open("sqlite3", "file:"+*honeypotDB+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("opening honeypot db %q for polling: %w", *honeypotDB, err)
+	}
+	defer db.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	stats := newDaemonStats()
+	go serveMetrics(ctx, stats)
+
+	var lastLoginID int
+	ticker := time.NewTicker(*pollInterval)
+	defer ticker.Stop()
+
+	for {
+		newIPs, maxID, err := pollNewLogins(db, lastLoginID)
+		if err != nil {
+			log.Println("daemon: poll failed:", err)
+		} else if len(newIPs) > 0 {
+			lastLoginID = maxID
+			runOnePass(newIPs, stats)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("daemon: shutting down gracefully")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollNewLogins returns the unique IPs from Login rows with LoginID greater
+// than sinceID, plus the highest LoginID seen, so the caller can advance its
+// watermark only once those IPs have actually been processed.
+func pollNewLogins(db *sql.DB, sinceID int) (ips []string, maxID int, err error) {
+	rows, err := db.Query("SELECT * FROM Login WHERE LoginID > ? ORDER BY LoginID;", sinceID)
+	if err != nil {
+		return nil, sinceID, err
+	}
+	var loginRecords []LoginData
+	sqlx.StructScan(rows, &loginRecords)
+	if err := rows.Close(); err != nil {
+		return nil, sinceID, err
+	}
+	if len(loginRecords) == 0 {
+		return nil, sinceID, nil
+	}
+	maxID = sinceID
+	for _, record := range loginRecords {
+		if record.LoginID > maxID {
+			maxID = record.LoginID
+		}
+	}
+	return uniqLoginIPs(loginRecords), maxID, nil
+}
+
+// runOnePass runs the cache -> lookup -> store pipeline for a batch of IPs
+// and folds the results into stats, logging but not panicking on failure so
+// one bad pass doesn't kill the daemon.
+func runOnePass(ips []string, stats *daemonStats) {
+	uncached, cacheStats := filterUncachedIPs(ips, *cacheTTL, *negativeTTL)
+	geolocData, err := getDataWithRateLimit(uncached)
+	if err != nil {
+		log.Println("daemon: lookup pass failed:", err)
+		stats.recordPass(len(uncached), cacheStats, 1)
+		return
+	}
+	if err := storeGeolocationData(geolocData); err != nil {
+		log.Println("daemon: store pass failed:", err)
+		stats.recordPass(len(uncached), cacheStats, 1)
+		return
+	}
+	stats.recordPass(0, cacheStats, 0)
+}
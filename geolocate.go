@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -15,12 +17,25 @@ import (
 )
 
 const (
-	defaultFields = "city,country,countryCode,region,regionName,city,isp,org,as,mobile,proxy,hosting,query"
-	ReqPerMin = 14 //How many requests per minute should we make to the API?
+	defaultFields = "status,message,city,country,countryCode,region,regionName,city,isp,org,as,mobile,proxy,hosting,query"
+	ReqPerMin = 14 //How many requests per minute should we make to the API? (seed value - the limiter re-tunes itself from X-Rl/X-Ttl)
 )
 
 var Database *sql.DB
 
+// httpClient is used for all outbound API calls; swapping its Transport lets
+// callers (and tests) substitute a fake http.RoundTripper.
+var httpClient = &http.Client{}
+
+// retryClient wraps httpClient with exponential backoff + jitter so a single
+// dropped connection or transient 5xx/429 doesn't take down a whole run.
+var retryClient = newRetryableClient()
+
+// limiter is the shared GCRA budget for talking to ip-api.com. It starts out
+// tuned to the documented 15 req/min batch quota (minus one for safety
+// margin) and re-tunes itself from the X-Rl/X-Ttl headers on every response.
+var limiter = NewRateLimiter(ReqPerMin, time.Minute, 1)
+
 // LoginData describes the format of a Login record from the honeypot database.
 type LoginData struct {
 	LoginID       int    `db:"LoginID"`
@@ -39,6 +54,8 @@ type ApiRequest struct {
 
 //ApiResponse represents the structure of the JSON object that the API will return, the data associated with the IP.
 type ApiResponse struct {
+	Status      string `json:"status"`  // "success" or "fail"
+	Message     string `json:"message"` // reason for failure, e.g. "private range", only set when Status is "fail"
 	Country     string `json:"country"`
 	CountryCode string `json:"countryCode"`
 	Region      string `json:"region"`
@@ -53,11 +70,25 @@ type ApiResponse struct {
 	Query       string `json:"query"`
 }
 
+var configPath = flag.String("config", "", "path to a JSON/YAML provider chain config (default: ip-api.com only)")
+
 func main() {
+	flag.Parse()
 	err := connectDB() //Connect to the Honeypot's database
 	if err != nil {
 		log.Panicln(err)
 	}
+	if err := ensureGeolocationSchema(); err != nil {
+		log.Panicln(err)
+	}
+
+	if *daemonMode {
+		if err := runDaemon(); err != nil {
+			log.Panicln(err)
+		}
+		return
+	}
+
 	loginRecords, err := getLoginDataFromDB() //Read in Login records
 	if err != nil {
 		log.Panicln(err)
@@ -67,13 +98,44 @@ func main() {
 	// prettyPrint, _ := json.Marshal(ips)
 	// log.Println(string(prettyPrint))
 	log.Println(len(ips))
-	geolocData, err := getDataWithRateLimit(ips) //Get data from the API
-	if err != nil {
-		log.Panicln(err)
+
+	ips, cacheStats := filterUncachedIPs(ips, *cacheTTL, *negativeTTL)
+	log.Printf("cache: %d hits, %d misses", cacheStats.Hits, cacheStats.Misses)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var geolocData []ApiResponse
+	alreadyStored := false
+	switch {
+	case *configPath != "":
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+		chain, err := BuildProviderChain(cfg)
+		if err != nil {
+			log.Panicln(err)
+		}
+		geolocData = chain.Lookup(ips)
+	case *workerCount > 1:
+		geolocData, err = getDataConcurrently(ctx, ips, *workerCount) //Fetch chunks with a shared rate budget across N workers; results are stored as they arrive.
+		if err != nil && err != context.Canceled {
+			log.Panicln(err)
+		}
+		alreadyStored = true
+	default:
+		geolocData, err = getDataWithRateLimit(ips) //Get data from the API
+		if err != nil {
+			log.Panicln(err)
+		}
 	}
-	err = storeGeolocationData(geolocData) //Write the geolocation data out to the database
-	if err != nil {
-		log.Panicln(err)
+
+	if !alreadyStored {
+		err = storeGeolocationData(geolocData) //Write the geolocation data out to the database
+		if err != nil {
+			log.Panicln(err)
+		}
 	}
 }
 
@@ -91,7 +153,15 @@ func uniqLoginIPs(loginRecords []LoginData) []string {
 	return keys
 }
 
-//getDataWithRateLimit performs the HTTP requests to IP-API.com.
+// failedChunks persists batches that exhausted every retry attempt so the
+// next invocation can resume them instead of restarting the whole run.
+var failedChunks = NewFailedChunkQueue("geolocate-resume-queue.json")
+
+//getDataWithRateLimit performs the HTTP requests to IP-API.com, staying under
+//the shared RateLimiter's budget rather than sleeping a fixed amount per chunk.
+//Transient failures are retried with backoff inside getGeolocationData; a
+//chunk that still fails after that is queued for a later run rather than
+//aborting the whole batch.
 func getDataWithRateLimit(ipSlice []string) ([]ApiResponse, error) {
 	var responseData []ApiResponse
 	loginRecordsAligned := make([]string, ((len(ipSlice)/100)+1)*100)
@@ -100,47 +170,31 @@ func getDataWithRateLimit(ipSlice []string) ([]ApiResponse, error) {
 	for i := 0; i < len(ipSlice); i += 100 { //IP-API can process sets of 100 IP addresses on the Batch endpoint
 		chunks = append(chunks, loginRecordsAligned[i:i+100])
 	}
-	//TODO Rate limiting should be be massively improved - see extract from documentation below
-	//If you go over the limit your requests will be throttled (HTTP 429) until your rate limit window is reset. If you constantly go over the limit your IP address will be banned for 1 hour.
 
-	//The returned HTTP header X-Rl contains the number of requests remaining in the current rate limit window. X-Ttl contains the seconds until the limit is reset.
-	//Your implementation should always check the value of the X-Rl header, and if its is 0 you must not send any more requests for the duration of X-Ttl in seconds.
+	if resumed, err := failedChunks.Drain(); err != nil {
+		log.Println("couldn't read resume queue, starting fresh:", err)
+	} else if len(resumed) > 0 {
+		log.Printf("resuming %d chunk(s) left over from a previous run", len(resumed))
+		chunks = append(resumed, chunks...)
+	}
+
 	for index, chunk := range chunks {
 		log.Println("Grabbing data for chunk: ", index)
-		statusCode, err, retryAfter, data := getGeolocationData(chunk)
+		limiter.Wait()
+		statusCode, err, _, data := getGeolocationData(chunk)
 		if err != nil {
-			log.Panicln(err)
-		}
-		//Rate limit our requests, particularly if the API instructs us to.
-		if statusCode == http.StatusTooManyRequests {
-			backoffTime, err := strconv.Atoi(retryAfter)
-			if err != nil {
-				log.Println("Couldn't get RetryAfter seconds, got: ", retryAfter, err.Error())
-				log.Println("Waiting for a minute due to RetryAfter failing to parse")
-				time.Sleep(time.Second * 60)
-			} else {
-				log.Printf("429, backing off for %vs\n", backoffTime)
-				time.Sleep(time.Second * time.Duration(backoffTime))
-			}
-			statusCode, err, retryAfter, data = getGeolocationData(chunk)
-			if err != nil {
-				log.Panicln(err)
-			}
-			if data != nil {
-				responseData = append(responseData, data...)
-			}
-			if (index+1) % ReqPerMin == 0 {
-				log.Println("Waiting for 60s to avoid rate limit")
-				time.Sleep(time.Second * 60)
-			}
-		} else {
-			if data != nil {
-				responseData = append(responseData, data...)
-			}
-			if (index+1) % ReqPerMin == 0 {
-				log.Println("Waiting for 60s to avoid rate limit")
-				time.Sleep(time.Second * 60)
+			log.Printf("chunk %d failed after retries, queueing for next run: %v", index, err)
+			if qerr := failedChunks.Push(chunk); qerr != nil {
+				log.Println("failed to persist chunk to resume queue:", qerr)
 			}
+			continue
+		}
+		if statusCode != http.StatusOK {
+			log.Printf("chunk %d: unexpected terminal status %d, skipping", index, statusCode)
+			continue
+		}
+		if data != nil {
+			responseData = append(responseData, data...)
 		}
 	}
 	return responseData, nil
@@ -171,6 +225,13 @@ func getLoginDataFromDB() ([]LoginData, error) {
 
 // getGeolocationData expects slices of IP addresses as strings, with a size of 100 items at most.
 func getGeolocationData(ipSlice []string) (statusCode int, err error, retryAfter string, data []ApiResponse) {
+	return getGeolocationDataWith(limiter, ipSlice)
+}
+
+// getGeolocationDataWith is getGeolocationData parameterised over the
+// RateLimiter to tune, so a ProviderChain can give ip-api.com its own budget
+// instead of clobbering the package-level default.
+func getGeolocationDataWith(l *RateLimiter, ipSlice []string) (statusCode int, err error, retryAfter string, data []ApiResponse) {
 	var apiRequestContent []ApiRequest
 	for _, record := range ipSlice {
 		if record != "" { //THis deals with the final "chunk" which ends in several empty strings
@@ -179,7 +240,7 @@ func getGeolocationData(ipSlice []string) (statusCode int, err error, retryAfter
 	}
 	log.Println("Prepared request data")
 	buff, err := json.Marshal(apiRequestContent)
-	resp, err := http.Post("http://ip-api.com/batch", "application/json", bytes.NewBuffer(buff)) //Send JSON content to the API.
+	resp, err := retryClient.Post("http://ip-api.com/batch", "application/json", buff) //Send JSON content to the API, retrying transient failures.
 	log.Println("Sent request")
 	if err != nil {
 		//log.Println(err.Error())
@@ -189,6 +250,10 @@ func getGeolocationData(ipSlice []string) (statusCode int, err error, retryAfter
 		return resp.StatusCode, nil, resp.Header.Get("Retry-After"), nil
 	}
 
+	if remaining, resetIn, ok := parseRateHeaders(resp.Header.Get("X-Rl"), resp.Header.Get("X-Ttl")); ok {
+		l.Tune(remaining, resetIn)
+	}
+
 	err = json.NewDecoder(resp.Body).Decode(&data)
 	if err != nil {
 		return -1, err, "", nil
@@ -197,9 +262,18 @@ func getGeolocationData(ipSlice []string) (statusCode int, err error, retryAfter
 }
 
 func storeGeolocationData(data []ApiResponse) (error) {
+	now := time.Now().UTC().Format(time.RFC3339)
 	for _, record := range data {
-		_, err := Database.Exec("INSERT INTO Geolocation (RemoteIP, Country, CountryCode, Region, RegionName, Zip, ISP, ASN, Mobile, Proxy, Hosting) VALUES (?,?,?,?,?,?,?,?,?,?,?);",
-		record.Query, record.Country, record.CountryCode, record.Region, record.RegionName, record.Zip, record.ISP, record.AS, record.Mobile, record.Proxy, record.Hosting)
+		status := record.Status
+		if status == "" {
+			status = "success"
+		}
+		_, err := Database.Exec(`INSERT INTO Geolocation (RemoteIP, Country, CountryCode, Region, RegionName, Zip, ISP, ASN, Mobile, Proxy, Hosting, Status, LookedUpAt) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)
+			ON CONFLICT(RemoteIP) DO UPDATE SET
+				Country=excluded.Country, CountryCode=excluded.CountryCode, Region=excluded.Region, RegionName=excluded.RegionName,
+				Zip=excluded.Zip, ISP=excluded.ISP, ASN=excluded.ASN, Mobile=excluded.Mobile, Proxy=excluded.Proxy, Hosting=excluded.Hosting,
+				Status=excluded.Status, LookedUpAt=excluded.LookedUpAt;`,
+			record.Query, record.Country, record.CountryCode, record.Region, record.RegionName, record.Zip, record.ISP, record.AS, record.Mobile, record.Proxy, record.Hosting, status, now)
 		if err != nil {
 			return err
 		}
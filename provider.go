@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoProvider is anything capable of turning a batch of IP addresses into
+// geolocation data. Implementations may be local (MaxMind) or remote
+// (ip-api.com, ipinfo.io), batched or per-IP - the ProviderChain hides the
+// difference from callers.
+type GeoProvider interface {
+	// Lookup resolves as many of ips as it can. A partial result plus a
+	// non-nil error is valid: the caller inspects which queries came back
+	// and hands the rest to the next provider in the chain.
+	Lookup(ips []string) ([]ApiResponse, error)
+	// BatchSize is the most IPs this provider wants handed to it at once.
+	BatchSize() int
+	// Name identifies the provider in logs and config.
+	Name() string
+}
+
+// ipApiProvider is the original ip-api.com batch endpoint, now expressed as a
+// GeoProvider so it can sit in a ProviderChain alongside offline/backup ones.
+type ipApiProvider struct {
+	limiter *RateLimiter
+}
+
+func newIPAPIProvider() *ipApiProvider {
+	return &ipApiProvider{limiter: NewRateLimiter(ReqPerMin, time.Minute, 1)}
+}
+
+func (p *ipApiProvider) Name() string   { return "ip-api.com" }
+func (p *ipApiProvider) BatchSize() int { return 100 }
+
+func (p *ipApiProvider) Lookup(ips []string) ([]ApiResponse, error) {
+	p.limiter.Wait()
+	statusCode, err, retryAfter, data := getGeolocationDataWith(p.limiter, ips)
+	if err != nil {
+		return data, err
+	}
+	if statusCode == http.StatusTooManyRequests {
+		backoffTime, convErr := parseRetryAfter(retryAfter)
+		p.limiter.Penalize(backoffTime)
+		return data, fmt.Errorf("ip-api.com: rate limited, retry after %v (parse ok=%v)", backoffTime, convErr == nil)
+	}
+	if statusCode != http.StatusOK {
+		return data, fmt.Errorf("ip-api.com: unexpected status %d", statusCode)
+	}
+	return data, nil
+}
+
+// maxmindProvider reads geolocation out of a local GeoLite2-City mmdb file.
+// It never makes a network request, so it has no rate limiter and is a good
+// first or last link in a ProviderChain.
+type maxmindProvider struct {
+	db *geoip2.Reader
+}
+
+func newMaxMindProvider(dbPath string) (*maxmindProvider, error) {
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return &maxmindProvider{db: db}, nil
+}
+
+func (p *maxmindProvider) Name() string   { return "maxmind-geolite2" }
+func (p *maxmindProvider) BatchSize() int { return 10000 } // no upstream quota, limited only by memory
+
+func (p *maxmindProvider) Lookup(ips []string) ([]ApiResponse, error) {
+	var out []ApiResponse
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		record, err := p.db.City(parsed)
+		if err != nil {
+			continue
+		}
+		out = append(out, ApiResponse{
+			Country:     record.Country.Names["en"],
+			CountryCode: record.Country.IsoCode,
+			RegionName:  firstSubdivisionName(record),
+			Zip:         record.Postal.Code,
+			Query:       ip,
+		})
+	}
+	if len(out) != len(ips) {
+		return out, fmt.Errorf("maxmind-geolite2: resolved %d/%d IPs", len(out), len(ips))
+	}
+	return out, nil
+}
+
+func firstSubdivisionName(record *geoip2.City) string {
+	if len(record.Subdivisions) == 0 {
+		return ""
+	}
+	return record.Subdivisions[0].Names["en"]
+}
+
+// responseFormatIPAPI and responseFormatIPInfo are the response shapes
+// httpPerIPProvider knows how to decode - see ipAPIPerIPResponse and
+// ipinfoResponse below.
+const (
+	responseFormatIPAPI  = "ip-api"
+	responseFormatIPInfo = "ipinfo"
+)
+
+// ipinfoResponse mirrors the JSON shape of ipinfo.io/<ip>/json, which is not
+// field-compatible with ip-api.com's: country is already the ISO code (no
+// separate countryCode), region holds the region name, postal replaces zip,
+// and org bundles the ASN and ISP name together with no mobile/proxy/hosting
+// flags at all.
+type ipinfoResponse struct {
+	IP      string `json:"ip"`
+	City    string `json:"city"`
+	Region  string `json:"region"`
+	Country string `json:"country"`
+	Postal  string `json:"postal"`
+	Org     string `json:"org"`
+}
+
+func (r ipinfoResponse) toApiResponse() ApiResponse {
+	return ApiResponse{
+		Status:      "success",
+		Country:     r.Country,
+		CountryCode: r.Country,
+		Region:      r.Region,
+		RegionName:  r.Region,
+		Zip:         r.Postal,
+		ISP:         r.Org,
+		Org:         r.Org,
+		Query:       r.IP,
+	}
+}
+
+// httpPerIPProvider calls a single-IP JSON geolocation API (e.g. ipinfo.io)
+// once per address, for use as a last-resort fallback when both ip-api.com
+// and the local mmdb are unavailable.
+type httpPerIPProvider struct {
+	name           string
+	urlTmpl        string // must contain exactly one %s for the IP
+	responseFormat string // responseFormatIPAPI (default) or responseFormatIPInfo
+	limiter        *RateLimiter
+}
+
+func newHTTPPerIPProvider(name, urlTmpl, responseFormat string, quota int, window time.Duration) *httpPerIPProvider {
+	return &httpPerIPProvider{name: name, urlTmpl: urlTmpl, responseFormat: responseFormat, limiter: NewRateLimiter(quota, window, 1)}
+}
+
+func (p *httpPerIPProvider) Name() string   { return p.name }
+func (p *httpPerIPProvider) BatchSize() int { return 1 }
+
+func (p *httpPerIPProvider) Lookup(ips []string) ([]ApiResponse, error) {
+	var out []ApiResponse
+	for _, ip := range ips {
+		p.limiter.Wait()
+		resp, err := httpClient.Get(fmt.Sprintf(p.urlTmpl, ip))
+		if err != nil {
+			log.Printf("%s: lookup of %s failed: %v", p.name, ip, err)
+			continue
+		}
+		record, decodeErr := p.decode(resp.Body, ip)
+		resp.Body.Close()
+		if decodeErr != nil {
+			log.Printf("%s: decoding response for %s failed: %v", p.name, ip, decodeErr)
+			continue
+		}
+		out = append(out, record)
+	}
+	if len(out) != len(ips) {
+		return out, fmt.Errorf("%s: resolved %d/%d IPs", p.name, len(out), len(ips))
+	}
+	return out, nil
+}
+
+// decode parses one per-IP response according to p.responseFormat.
+func (p *httpPerIPProvider) decode(body io.Reader, ip string) (ApiResponse, error) {
+	if p.responseFormat == responseFormatIPInfo {
+		var r ipinfoResponse
+		if err := json.NewDecoder(body).Decode(&r); err != nil {
+			return ApiResponse{}, err
+		}
+		record := r.toApiResponse()
+		record.Query = ip
+		return record, nil
+	}
+	var record ApiResponse
+	if err := json.NewDecoder(body).Decode(&record); err != nil {
+		return ApiResponse{}, err
+	}
+	record.Query = ip
+	return record, nil
+}
+
+// ProviderChain tries each GeoProvider in order, handing off whatever IPs the
+// previous provider failed to resolve. A single exhausted quota or transient
+// error therefore degrades to the next provider rather than aborting the run.
+type ProviderChain struct {
+	providers []GeoProvider
+}
+
+func NewProviderChain(providers ...GeoProvider) *ProviderChain {
+	return &ProviderChain{providers: providers}
+}
+
+// Lookup resolves ips across the chain, merging partial results as it goes.
+func (c *ProviderChain) Lookup(ips []string) []ApiResponse {
+	var resolved []ApiResponse
+	remaining := ips
+	for _, provider := range c.providers {
+		if len(remaining) == 0 {
+			break
+		}
+		var chunkResults []ApiResponse
+		for i := 0; i < len(remaining); i += provider.BatchSize() {
+			end := i + provider.BatchSize()
+			if end > len(remaining) {
+				end = len(remaining)
+			}
+			data, err := provider.Lookup(remaining[i:end])
+			if err != nil {
+				log.Printf("%s: %v (falling back for the unresolved IPs)", provider.Name(), err)
+			}
+			chunkResults = append(chunkResults, data...)
+		}
+		resolved = append(resolved, chunkResults...)
+		remaining = missingIPs(remaining, chunkResults)
+	}
+	if len(remaining) > 0 {
+		log.Printf("provider chain exhausted with %d IPs still unresolved", len(remaining))
+	}
+	return resolved
+}
+
+// missingIPs returns the subset of ips that don't appear as a Query in got.
+func missingIPs(ips []string, got []ApiResponse) []string {
+	found := make(map[string]bool, len(got))
+	for _, r := range got {
+		found[r.Query] = true
+	}
+	var missing []string
+	for _, ip := range ips {
+		if !found[ip] {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
+}
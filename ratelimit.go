@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter implements the Generic Cell Rate Algorithm (GCRA), a token-bucket
+// variant that only needs a single timestamp (the "theoretical arrival time", or
+// TAT) rather than a ticking bucket of tokens. It is safe for concurrent use so a
+// single instance can be shared between batch and single-IP lookups against the
+// same upstream quota.
+type RateLimiter struct {
+	mu sync.Mutex
+
+	// tat is the theoretical arrival time: the point at which the bucket will
+	// next be empty, assuming no further requests are made.
+	tat time.Time
+
+	// emissionInterval is how much "cost" each request adds to the TAT. It is
+	// window / quota, and can be re-tuned at runtime as the upstream tells us
+	// more about its actual limits.
+	emissionInterval time.Duration
+
+	// burst is how many emission intervals we're allowed to run ahead of now
+	// before a request must be delayed or rejected.
+	burst int
+}
+
+// NewRateLimiter builds a RateLimiter that allows quota requests per window,
+// with burst extra requests permitted up front.
+func NewRateLimiter(quota int, window time.Duration, burst int) *RateLimiter {
+	return &RateLimiter{
+		tat:              time.Now(),
+		emissionInterval: window / time.Duration(quota),
+		burst:            burst,
+	}
+}
+
+// reserve advances the TAT for one request and returns the time at which
+// that request is allowed to go out: newTAT - burst*emissionInterval, per
+// the GCRA rule that a request is delayed once newTAT-now exceeds
+// burst*emissionInterval.
+func (r *RateLimiter) reserve() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	tat := r.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(r.emissionInterval)
+	allowAt := newTAT.Add(-time.Duration(r.burst) * r.emissionInterval)
+	r.tat = newTAT
+	return allowAt
+}
+
+// Wait blocks until a request may be made, then reserves the slot. It returns
+// the duration actually slept, which callers may log.
+func (r *RateLimiter) Wait() time.Duration {
+	allowAt := r.reserve()
+	if wait := time.Until(allowAt); wait > 0 {
+		time.Sleep(wait)
+		return wait
+	}
+	return 0
+}
+
+// WaitContext is Wait, but returns early with ctx.Err() if ctx is cancelled
+// before the reserved slot arrives - used by the concurrent worker pool so a
+// SIGINT doesn't have to wait out a long GCRA delay before workers exit.
+func (r *RateLimiter) WaitContext(ctx context.Context) error {
+	allowAt := r.reserve()
+	if wait := time.Until(allowAt); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Tune re-derives the emission interval from the X-Rl (requests remaining) and
+// X-Ttl (seconds until the window resets) headers ip-api.com returns on every
+// response, so we track the upstream's actual budget rather than a fixed guess.
+func (r *RateLimiter) Tune(remaining int, resetIn time.Duration) {
+	if remaining <= 0 || resetIn <= 0 {
+		return
+	}
+	interval := resetIn / time.Duration(remaining)
+
+	r.mu.Lock()
+	r.emissionInterval = interval
+	r.mu.Unlock()
+}
+
+// Budget reports the current emission interval - how long the limiter
+// thinks it must wait between requests given what it's learned from Tune -
+// so callers can surface the live rate-limit budget rather than a static
+// constructor constant.
+func (r *RateLimiter) Budget() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.emissionInterval
+}
+
+// Penalize pushes the TAT forward by d, used when the upstream returns a 429
+// with an explicit Retry-After so the next Wait() honours it.
+func (r *RateLimiter) Penalize(d time.Duration) {
+	r.mu.Lock()
+	now := time.Now()
+	if r.tat.Before(now) {
+		r.tat = now
+	}
+	r.tat = r.tat.Add(d)
+	r.mu.Unlock()
+}
+
+// parseRetryAfter converts a Retry-After header value (seconds) into a
+// duration, defaulting to 60s if the header is missing or unparsable.
+func parseRetryAfter(retryAfter string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(retryAfter)
+	if err != nil {
+		return 60 * time.Second, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseRateHeaders extracts the X-Rl and X-Ttl values from an ip-api.com
+// response, returning ok=false if either header is missing or unparsable.
+func parseRateHeaders(rl, ttl string) (remaining int, resetIn time.Duration, ok bool) {
+	remainingVal, err := strconv.Atoi(rl)
+	if err != nil {
+		return 0, 0, false
+	}
+	ttlVal, err := strconv.Atoi(ttl)
+	if err != nil {
+		return 0, 0, false
+	}
+	return remainingVal, time.Duration(ttlVal) * time.Second, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRoundTripper is a minimal http.RoundTripper that returns a canned
+// response carrying synthetic X-Rl/X-Ttl headers, so tests can drive
+// getGeolocationData's rate-limit tuning without hitting the network.
+type fakeRoundTripper struct {
+	status int
+	rl     string
+	ttl    string
+	body   string
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	if f.rl != "" {
+		header.Set("X-Rl", f.rl)
+	}
+	if f.ttl != "" {
+		header.Set("X-Ttl", f.ttl)
+	}
+	return &http.Response{
+		StatusCode: f.status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(f.body)),
+		Request:    req,
+	}, nil
+}
+
+func withFakeTransport(t *testing.T, rt http.RoundTripper) {
+	t.Helper()
+	original := httpClient.Transport
+	httpClient.Transport = rt
+	t.Cleanup(func() { httpClient.Transport = original })
+}
+
+func TestGetGeolocationDataTunesLimiterFromHeaders(t *testing.T) {
+	withFakeTransport(t, &fakeRoundTripper{
+		status: http.StatusOK,
+		rl:     "5",
+		ttl:    "10",
+		body:   `[{"status":"success","query":"1.2.3.4"}]`,
+	})
+
+	l := NewRateLimiter(14, time.Minute, 1)
+	statusCode, err, _, data := getGeolocationDataWith(l, []string{"1.2.3.4"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statusCode != http.StatusOK {
+		t.Fatalf("statusCode = %d, want 200", statusCode)
+	}
+	if len(data) != 1 || data[0].Query != "1.2.3.4" {
+		t.Fatalf("unexpected data: %+v", data)
+	}
+
+	// X-Rl: 5, X-Ttl: 10s -> emission interval should become 10s/5 = 2s.
+	if got, want := l.Budget(), 2*time.Second; got != want {
+		t.Errorf("Budget() = %v, want %v", got, want)
+	}
+}
+
+func TestGetGeolocationDataIgnoresMissingRateHeaders(t *testing.T) {
+	withFakeTransport(t, &fakeRoundTripper{
+		status: http.StatusOK,
+		body:   `[{"status":"success","query":"1.2.3.4"}]`,
+	})
+
+	l := NewRateLimiter(14, time.Minute, 1)
+	before := l.Budget()
+	if _, err, _, _ := getGeolocationDataWith(l, []string{"1.2.3.4"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := l.Budget(); got != before {
+		t.Errorf("Budget() changed from %v to %v without valid rate headers", before, got)
+	}
+}
+
+func TestParseRateHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		rl, ttl     string
+		wantOK      bool
+		wantRemain  int
+		wantResetIn time.Duration
+	}{
+		{"valid", "3", "15", true, 3, 15 * time.Second},
+		{"non-numeric remaining", "x", "15", false, 0, 0},
+		{"non-numeric ttl", "3", "x", false, 0, 0},
+		{"both missing", "", "", false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, resetIn, ok := parseRateHeaders(tt.rl, tt.ttl)
+			if ok != tt.wantOK || remaining != tt.wantRemain || resetIn != tt.wantResetIn {
+				t.Errorf("parseRateHeaders(%q, %q) = (%d, %v, %v), want (%d, %v, %v)",
+					tt.rl, tt.ttl, remaining, resetIn, ok, tt.wantRemain, tt.wantResetIn, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRateLimiterTune(t *testing.T) {
+	l := NewRateLimiter(14, time.Minute, 1)
+
+	l.Tune(0, 10*time.Second) // remaining <= 0 must be ignored
+	if got, want := l.Budget(), time.Minute/14; got != want {
+		t.Fatalf("Tune(0, ...) changed the budget to %v, want unchanged %v", got, want)
+	}
+
+	l.Tune(10, 20*time.Second)
+	if got, want := l.Budget(), 2*time.Second; got != want {
+		t.Fatalf("Budget() after Tune(10, 20s) = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiterWaitRespectsBurst(t *testing.T) {
+	const burst = 2
+	l := NewRateLimiter(20, time.Second, burst) // emissionInterval = 50ms
+
+	// The first `burst` requests should be allowed through with negligible
+	// delay; only once the burst is exhausted should Wait start enforcing
+	// the emission interval.
+	for i := 0; i < burst; i++ {
+		if wait := l.Wait(); wait > 10*time.Millisecond {
+			t.Errorf("request %d waited %v, want ~0 while inside burst", i, wait)
+		}
+	}
+
+	wait := l.Wait()
+	if wait < 30*time.Millisecond {
+		t.Errorf("request after burst waited %v, want close to the 50ms emission interval", wait)
+	}
+}
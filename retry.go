@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// retryableClient wraps an *http.Client with exponential backoff and full
+// jitter (similar in spirit to hashicorp/go-retryablehttp), so a single
+// dropped connection or transient 5xx/429 doesn't take down a whole run.
+type retryableClient struct {
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func newRetryableClient() *retryableClient {
+	return &retryableClient{
+		client:      httpClient,
+		maxAttempts: 5,
+		baseDelay:   time.Second,
+		maxDelay:    5 * time.Minute,
+	}
+}
+
+// Post sends body to url, retrying on connection errors, 5xx and 429. Any
+// other 4xx is treated as terminal and returned immediately so callers don't
+// waste attempts on a request that will never succeed.
+func (c *retryableClient) Post(url, contentType string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(c.backoff(attempt))
+		}
+		resp, err := c.client.Post(url, contentType, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue // connection errors are always worth retrying
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("retryable status %d from %s", resp.StatusCode, url)
+			resp.Body.Close() // don't leak the connection across retries
+			continue
+		}
+		return resp, nil // success or a terminal 4xx - let the caller interpret the status code
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", c.maxAttempts, lastErr)
+}
+
+// backoff computes sleep = min(cap, base * 2^attempt) * rand(0,1) - "full
+// jitter" as described in the AWS architecture blog post on backoff
+// strategies, which avoids every retrying client waking up in lockstep.
+func (c *retryableClient) backoff(attempt int) time.Duration {
+	capped := c.baseDelay * time.Duration(1<<uint(attempt))
+	if capped > c.maxDelay {
+		capped = c.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(capped) + 1))
+}
+
+// FailedChunkQueue persists IP chunks that exhausted all retry attempts to
+// disk, so a subsequent invocation can resume the batch instead of
+// restarting the whole run from scratch. Push/Drain are safe for concurrent
+// use, since the worker pool has multiple goroutines pushing to the same
+// queue at once.
+type FailedChunkQueue struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFailedChunkQueue(path string) *FailedChunkQueue {
+	return &FailedChunkQueue{path: path}
+}
+
+// Push appends chunk to the on-disk queue.
+func (q *FailedChunkQueue) Push(chunk []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, err := q.loadOrEmpty()
+	if err != nil {
+		return err
+	}
+	pending = append(pending, chunk)
+	return q.save(pending)
+}
+
+// Drain returns every queued chunk and clears the queue.
+func (q *FailedChunkQueue) Drain() ([][]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, err := q.loadOrEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (q *FailedChunkQueue) loadOrEmpty() ([][]string, error) {
+	raw, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending [][]string
+	if err := json.Unmarshal(raw, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (q *FailedChunkQueue) save(pending [][]string) error {
+	raw, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.path, raw, 0o644)
+}
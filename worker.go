@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var workerCount = flag.Int("workers", 1, "number of concurrent chunk-fetch workers sharing the rate-limit budget (1 = original serial behaviour)")
+
+// chunkIPs splits ipSlice into batches of at most size, zero-padding the
+// final batch the same way getDataWithRateLimit always has so the empty
+// strings get filtered out downstream in getGeolocationData.
+func chunkIPs(ipSlice []string, size int) [][]string {
+	aligned := make([]string, ((len(ipSlice)/size)+1)*size)
+	copy(aligned, ipSlice)
+	var chunks [][]string
+	for i := 0; i < len(ipSlice); i += size {
+		chunks = append(chunks, aligned[i:i+size])
+	}
+	return chunks
+}
+
+// getDataConcurrently is getDataWithRateLimit's worker-pool sibling: workers
+// goroutines pull chunks off a channel and share the single package-level
+// limiter, so the degree of concurrency is tunable independently of the rate
+// budget - a couple of workers keep the pipe saturated while others are
+// sleeping out a GCRA delay or backoff. Results are written to the DB by a
+// write-behind goroutine, so a slow insert never stalls an API worker, and
+// ctx cancellation (e.g. SIGINT) stops new work from being dispatched and
+// lets in-flight chunks finish before returning.
+func getDataConcurrently(ctx context.Context, ipSlice []string, workers int) ([]ApiResponse, error) {
+	chunks := chunkIPs(ipSlice, 100)
+
+	if resumed, err := failedChunks.Drain(); err != nil {
+		log.Println("couldn't read resume queue, starting fresh:", err)
+	} else if len(resumed) > 0 {
+		log.Printf("resuming %d chunk(s) left over from a previous run", len(resumed))
+		chunks = append(resumed, chunks...)
+	}
+
+	jobs := make(chan int)
+	results := make(chan []ApiResponse, len(chunks))
+	store := newWriteBehindStore()
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				if err := limiter.WaitContext(ctx); err != nil {
+					return // ctx cancelled while waiting for budget
+				}
+				log.Println("Grabbing data for chunk: ", index)
+				statusCode, err, _, data := getGeolocationData(chunks[index])
+				if err != nil {
+					log.Printf("chunk %d failed after retries, queueing for next run: %v", index, err)
+					if qerr := failedChunks.Push(chunks[index]); qerr != nil {
+						log.Println("failed to persist chunk to resume queue:", qerr)
+					}
+					continue
+				}
+				if statusCode != http.StatusOK {
+					log.Printf("chunk %d: unexpected terminal status %d, skipping", index, statusCode)
+					continue
+				}
+				if data == nil {
+					continue
+				}
+				store.Enqueue(data)
+				results <- data
+			}
+		}()
+	}
+
+feed:
+	for index := range chunks {
+		select {
+		case jobs <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var responseData []ApiResponse
+	for data := range results {
+		responseData = append(responseData, data...)
+	}
+	return responseData, ctx.Err()
+}
+
+// writeBehindStore buffers ApiResponse batches and persists them on its own
+// goroutine, decoupling DB writes from the workers fetching new chunks.
+type writeBehindStore struct {
+	queue chan []ApiResponse
+	done  chan struct{}
+}
+
+func newWriteBehindStore() *writeBehindStore {
+	s := &writeBehindStore{queue: make(chan []ApiResponse, 16), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for batch := range s.queue {
+			if err := storeGeolocationData(batch); err != nil {
+				log.Println("write-behind store failed:", err)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *writeBehindStore) Enqueue(batch []ApiResponse) {
+	s.queue <- batch
+}
+
+// Close drains any queued batches and waits for them to be persisted before
+// returning.
+func (s *writeBehindStore) Close() {
+	close(s.queue)
+	<-s.done
+}